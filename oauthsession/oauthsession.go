@@ -0,0 +1,321 @@
+// Package oauthsession layers an OAuth2/OIDC login flow on top of a
+// gorilla/sessions store. Tokens and ID token claims are kept in the
+// session, so any sessions.Store implementation that persists them -
+// boltstore in particular - doubles as the token store.
+package oauthsession
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// Session value keys under which Middleware stores OAuth2/OIDC state.
+// Unexported, as the bucket format is an implementation detail.
+const (
+	keyAccessToken  = "oauthsession.access_token"
+	keyTokenType    = "oauthsession.token_type"
+	keyRefreshToken = "oauthsession.refresh_token"
+	keyExpiry       = "oauthsession.expiry"
+	keyRawIDToken   = "oauthsession.raw_id_token"
+	keyState        = "oauthsession.state"
+)
+
+// A Verifier verifies a raw ID token. *oidc.IDTokenVerifier satisfies this
+// interface.
+type Verifier interface {
+	Verify(ctx context.Context, rawIDToken string) (*oidc.IDToken, error)
+}
+
+// An Option configures a Middleware.
+type Option func(*Middleware)
+
+// SessionName sets the name under which the gorilla session is stored.
+// Defaults to "oauthsession".
+func SessionName(name string) Option {
+	return func(m *Middleware) { m.sessionName = name }
+}
+
+// CallbackPath sets the path the OAuth2 provider redirects back to after
+// login. Requests to this path are handled by Middleware itself and never
+// reach the wrapped handler. Defaults to "/oauth2/callback".
+func CallbackPath(path string) Option {
+	return func(m *Middleware) { m.callbackPath = path }
+}
+
+// RevocationEndpoint sets the provider's RFC 7009 token revocation
+// endpoint. If never set, Logout does not attempt to revoke the refresh
+// token with the provider, and only removes the local session.
+func RevocationEndpoint(endpoint string) Option {
+	return func(m *Middleware) { m.revocationEndpoint = endpoint }
+}
+
+// OnLogin registers f to be called once a login completes successfully,
+// with the session that was just populated and the verified ID token.
+func OnLogin(f func(*sessions.Session, *oidc.IDToken)) Option {
+	return func(m *Middleware) { m.onLogin = f }
+}
+
+// Middleware authenticates requests against an OAuth2/OIDC provider,
+// persisting tokens in a gorilla session backed by a sessions.Store.
+type Middleware struct {
+	config   oauth2.Config
+	verifier Verifier
+	store    sessions.Store
+
+	sessionName        string
+	callbackPath       string
+	revocationEndpoint string
+	onLogin            func(*sessions.Session, *oidc.IDToken)
+}
+
+// AuthMiddleware creates a Middleware that authenticates requests against
+// the OAuth2/OIDC provider described by config and verifier, storing
+// session state via store.
+func AuthMiddleware(store sessions.Store, config oauth2.Config, verifier Verifier, opts ...Option) *Middleware {
+	m := &Middleware{
+		config:       config,
+		verifier:     verifier,
+		store:        store,
+		sessionName:  "oauthsession",
+		callbackPath: "/oauth2/callback",
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Wrap returns an http.Handler that authenticates requests before calling
+// next. Unauthenticated requests are redirected to the provider's login
+// page; requests to the configured callback path are handled by Middleware
+// itself and never reach next.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == m.callbackPath {
+			m.handleCallback(w, r)
+			return
+		}
+
+		sess, err := m.store.Get(r, m.sessionName)
+		if err != nil {
+			http.Error(w, "oauthsession: retrieving session", http.StatusInternalServerError)
+			return
+		}
+
+		token, ok := m.tokenFromSession(sess)
+		if !ok {
+			m.redirectToProvider(w, r, sess)
+			return
+		}
+
+		refreshed, err := m.refreshIfNeeded(r.Context(), sess, token)
+		if err != nil {
+			m.redirectToProvider(w, r, sess)
+			return
+		}
+
+		if refreshed {
+			if err := sess.Save(r, w); err != nil {
+				http.Error(w, "oauthsession: saving session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToProvider stashes an anti-CSRF state value in sess and redirects
+// the browser to the provider's consent page.
+func (m *Middleware) redirectToProvider(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	state, err := randomState()
+	if err != nil {
+		http.Error(w, "oauthsession: generating state", http.StatusInternalServerError)
+		return
+	}
+	sess.Values[keyState] = state
+	if err := sess.Save(r, w); err != nil {
+		http.Error(w, "oauthsession: saving session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, m.config.AuthCodeURL(state), http.StatusFound)
+}
+
+// handleCallback exchanges the authorization code for tokens, verifies the
+// ID token and stores everything in the session.
+func (m *Middleware) handleCallback(w http.ResponseWriter, r *http.Request) {
+	sess, err := m.store.Get(r, m.sessionName)
+	if err != nil {
+		http.Error(w, "oauthsession: retrieving session", http.StatusInternalServerError)
+		return
+	}
+
+	state, _ := sess.Values[keyState].(string)
+	if state == "" || state != r.URL.Query().Get("state") {
+		http.Error(w, "oauthsession: invalid state", http.StatusBadRequest)
+		return
+	}
+	delete(sess.Values, keyState)
+
+	token, err := m.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("oauthsession: exchanging code: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	idToken, err := m.storeToken(r.Context(), sess, token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("oauthsession: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	if err := sess.Save(r, w); err != nil {
+		http.Error(w, "oauthsession: saving session", http.StatusInternalServerError)
+		return
+	}
+
+	if m.onLogin != nil {
+		m.onLogin(sess, idToken)
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// storeToken verifies the ID token carried by token and stashes it, along
+// with the access and refresh tokens, in sess.Values.
+func (m *Middleware) storeToken(ctx context.Context, sess *sessions.Session, token *oauth2.Token) (*oidc.IDToken, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+	idToken, err := m.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id_token: %s", err)
+	}
+
+	sess.Values[keyAccessToken] = token.AccessToken
+	sess.Values[keyTokenType] = token.TokenType
+	sess.Values[keyRefreshToken] = token.RefreshToken
+	sess.Values[keyExpiry] = token.Expiry.Unix()
+	sess.Values[keyRawIDToken] = rawIDToken
+
+	return idToken, nil
+}
+
+// tokenFromSession reconstructs an *oauth2.Token from sess, or reports
+// false if sess carries no token.
+func (m *Middleware) tokenFromSession(sess *sessions.Session) (*oauth2.Token, bool) {
+	access, ok := sess.Values[keyAccessToken].(string)
+	if !ok || access == "" {
+		return nil, false
+	}
+	tokenType, _ := sess.Values[keyTokenType].(string)
+	refresh, _ := sess.Values[keyRefreshToken].(string)
+
+	return &oauth2.Token{
+		AccessToken:  access,
+		TokenType:    tokenType,
+		RefreshToken: refresh,
+		Expiry:       expiryFromValue(sess.Values[keyExpiry]),
+	}, true
+}
+
+// expiryFromValue recovers the Unix timestamp storeToken/refreshIfNeeded
+// stash under keyExpiry. It accepts both int64 (as stored, and as restored
+// by GobSerializer) and float64 (as restored by JSONSerializer, which
+// decodes all JSON numbers into float64), so the token expiry survives
+// either Serializer.
+func expiryFromValue(v interface{}) time.Time {
+	switch sec := v.(type) {
+	case int64:
+		return time.Unix(sec, 0)
+	case float64:
+		return time.Unix(int64(sec), 0)
+	default:
+		return time.Time{}
+	}
+}
+
+// refreshIfNeeded transparently refreshes token via config's TokenSource if
+// it has expired, persisting the result back into sess. It reports whether
+// sess was actually modified, so callers can skip re-saving an unchanged,
+// still-valid session on every request.
+func (m *Middleware) refreshIfNeeded(ctx context.Context, sess *sessions.Session, token *oauth2.Token) (bool, error) {
+	if token.Valid() {
+		return false, nil
+	}
+	fresh, err := m.config.TokenSource(ctx, token).Token()
+	if err != nil {
+		return false, fmt.Errorf("refreshing token: %s", err)
+	}
+	sess.Values[keyAccessToken] = fresh.AccessToken
+	sess.Values[keyTokenType] = fresh.TokenType
+	sess.Values[keyRefreshToken] = fresh.RefreshToken
+	sess.Values[keyExpiry] = fresh.Expiry.Unix()
+	return true, nil
+}
+
+// Logout revokes sess's refresh token with the provider, if
+// RevocationEndpoint was set, and removes sess from the store.
+func (m *Middleware) Logout(w http.ResponseWriter, r *http.Request) error {
+	sess, err := m.store.Get(r, m.sessionName)
+	if err != nil {
+		return fmt.Errorf("oauthsession: retrieving session: %s", err)
+	}
+
+	if m.revocationEndpoint != "" {
+		if refresh, ok := sess.Values[keyRefreshToken].(string); ok && refresh != "" {
+			if err := m.revoke(r.Context(), refresh); err != nil {
+				return fmt.Errorf("oauthsession: revoking token: %s", err)
+			}
+		}
+	}
+
+	sess.Options.MaxAge = -1
+	return sess.Save(r, w)
+}
+
+// revoke asks the provider's revocation endpoint to invalidate token, per
+// RFC 7009.
+func (m *Middleware) revoke(ctx context.Context, token string) error {
+	form := url.Values{
+		"token":         {token},
+		"client_id":     {m.config.ClientID},
+		"client_secret": {m.config.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.revocationEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("revocation endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,178 @@
+package oauthsession
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	boltstore "github.com/mwmahlberg/gorilla-boltstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
+)
+
+// fakeVerifier satisfies Verifier without talking to a real provider.
+type fakeVerifier struct{}
+
+func (fakeVerifier) Verify(_ context.Context, _ string) (*oidc.IDToken, error) {
+	return &oidc.IDToken{Subject: "test-subject"}, nil
+}
+
+// newTestStore returns a boltstore-backed sessions.Store over a temporary
+// database file, which is removed when the test completes.
+func newTestStore(t *testing.T, opts ...boltstore.SessionStoreOption) boltstore.SessionStore {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "oauthsession.*.db")
+	require.NoError(t, err)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	opts = append([]boltstore.SessionStoreOption{boltstore.Keys([]byte("0123456789abcdef0123456789abcdef"))}, opts...)
+	st, err := boltstore.New(db, opts...)
+	require.NoError(t, err)
+	return st
+}
+
+func TestHandleCallbackStateMismatch(t *testing.T) {
+	m := AuthMiddleware(newTestStore(t), oauth2.Config{}, fakeVerifier{})
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/oauth2/callback?state=attacker&code=abc", nil)
+	w := httptest.NewRecorder()
+
+	m.handleCallback(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts []boltstore.SessionStoreOption
+	}{
+		{desc: "GobSerializer (default)"},
+		{desc: "JSONSerializer", opts: []boltstore.SessionStoreOption{boltstore.WithSerializer(boltstore.JSONSerializer{})}},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			st := newTestStore(t, tC.opts...)
+			m := AuthMiddleware(st, oauth2.Config{}, fakeVerifier{})
+
+			token := (&oauth2.Token{
+				AccessToken:  "access-token",
+				RefreshToken: "refresh-token",
+				TokenType:    "Bearer",
+				Expiry:       time.Now().Add(time.Hour).Truncate(time.Second),
+			}).WithExtra(map[string]interface{}{"id_token": "raw.id.token"})
+
+			first := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			sess, err := st.Get(first, m.sessionName)
+			require.NoError(t, err)
+
+			_, err = m.storeToken(context.Background(), sess, token)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			require.NoError(t, sess.Save(first, w))
+			w.Flush()
+
+			second := first.Clone(context.Background())
+			second.AddCookie(w.Result().Cookies()[0])
+			restoredSess, err := st.Get(second, m.sessionName)
+			require.NoError(t, err)
+
+			restored, ok := m.tokenFromSession(restoredSess)
+			require.True(t, ok)
+			assert.Equal(t, token.AccessToken, restored.AccessToken)
+			assert.Equal(t, token.RefreshToken, restored.RefreshToken)
+			assert.WithinDuration(t, token.Expiry, restored.Expiry, time.Second)
+		})
+	}
+}
+
+func TestWrapSavesOnlyWhenRefreshed(t *testing.T) {
+	refreshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "refreshed-access",
+			"token_type":    "Bearer",
+			"refresh_token": "refreshed-refresh",
+			"expires_in":    3600,
+		})
+	}))
+	defer refreshServer.Close()
+
+	config := oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: refreshServer.URL},
+	}
+
+	setup := func(t *testing.T, expiry time.Time) (boltstore.SessionStore, *Middleware, []*http.Cookie) {
+		st := newTestStore(t)
+		m := AuthMiddleware(st, config, fakeVerifier{})
+
+		token := (&oauth2.Token{
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token",
+			TokenType:    "Bearer",
+			Expiry:       expiry,
+		}).WithExtra(map[string]interface{}{"id_token": "raw.id.token"})
+
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		sess, err := st.Get(r, m.sessionName)
+		require.NoError(t, err)
+		_, err = m.storeToken(context.Background(), sess, token)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, sess.Save(r, w))
+		w.Flush()
+
+		return st, m, w.Result().Cookies()
+	}
+
+	t.Run("valid token is not re-saved", func(t *testing.T) {
+		_, m, cookies := setup(t, time.Now().Add(time.Hour))
+
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+
+		called := false
+		m.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true })).ServeHTTP(w, r)
+
+		assert.True(t, called)
+		assert.Empty(t, w.Result().Cookies(), "session was re-saved although the token was still valid")
+	})
+
+	t.Run("expired token is refreshed and re-saved", func(t *testing.T) {
+		_, m, cookies := setup(t, time.Now().Add(-time.Hour))
+
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+
+		called := false
+		m.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true })).ServeHTTP(w, r)
+
+		assert.True(t, called)
+		assert.NotEmpty(t, w.Result().Cookies(), "session was not re-saved after the token was refreshed")
+	})
+}
@@ -1,20 +1,37 @@
 package boltstore
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	uuid "github.com/satori/go.uuid"
 	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
 )
 
 // DefaultBucketname is unsurprisingly the default name of the bucket in
 // which the sessions are stored.
 const DefaultBucketname = "_boltstore_sessions"
 
+// DefaultGCBatchSize is the number of entries inspected per GC transaction
+// when neither MinGCBatchSize nor MaxGCTxDuration is set to a more
+// restrictive value.
+const DefaultGCBatchSize = 1000
+
+// DefaultMaxGCTxDuration is the default upper bound on how long a single
+// GC transaction is allowed to run before it yields the bucket back to
+// regular readers and writers.
+const DefaultMaxGCTxDuration = 500 * time.Millisecond
+
 var (
 	// ErrInsufficientKeys is returned by New if no key were given for encryption
 	// and/or signing of the cookies.
@@ -32,34 +49,256 @@ type IDGeneratorFunc func(*http.Request) (string, error)
 type SessionStoreOption func(s *store) error
 
 type store struct {
-	db          *bolt.DB
-	genfunc     IDGeneratorFunc
-	bucket      []byte
-	sessionOpts *sessions.Options
-	codecs      []securecookie.Codec
+	db                 *bolt.DB
+	genfunc            IDGeneratorFunc
+	bucket             []byte
+	sessionOpts        *sessions.Options
+	codecs             []securecookie.Codec
+	legacyRawIDCookie  bool
+	serializer         Serializer
+	avoidEmptySessions bool
+
+	gcInterval      time.Duration
+	minGCBatchSize  int
+	maxGCTxDuration time.Duration
+	stopGC          chan struct{}
+	gcStopped       chan struct{}
+}
+
+// sessionRecord is what is actually stored in the bucket: the
+// securecookie-encoded session payload, plus the point in time at which it
+// is considered expired. A zero ExpiresAt means the record never expires.
+type sessionRecord struct {
+	Payload   string
+	ExpiresAt time.Time
+}
+
+func encodeRecord(rec sessionRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(raw []byte) (sessionRecord, error) {
+	var rec sessionRecord
+	err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&rec)
+	return rec, err
+}
+
+func (rec sessionRecord) expired(now time.Time) bool {
+	return !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(now)
+}
+
+// A Serializer turns a session's values into bytes suitable for storage in
+// the bucket, and back. The resulting bytes are still passed through
+// securecookie for authenticated encryption, so a Serializer only needs to
+// worry about the representation of the data, not its confidentiality or
+// integrity.
+type Serializer interface {
+	Serialize(sess *sessions.Session) ([]byte, error)
+	Deserialize(data []byte, sess *sessions.Session) error
+}
+
+// GobSerializer serializes session values using encoding/gob. It is the
+// default Serializer and requires gob.Register for any custom type stored
+// in session.Values.
+type GobSerializer struct{}
+
+// Serialize implements Serializer.
+func (GobSerializer) Serialize(sess *sessions.Session) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sess.Values); err != nil {
+		return nil, fmt.Errorf("gob serializer: encoding: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize implements Serializer.
+func (GobSerializer) Deserialize(data []byte, sess *sessions.Session) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sess.Values); err != nil {
+		return fmt.Errorf("gob serializer: decoding: %s", err)
+	}
+	return nil
+}
+
+// JSONSerializer serializes session values as a JSON object, like
+// gorilla/sessions' redistore. Since JSON object keys must be strings, every
+// key in session.Values must be a string.
+type JSONSerializer struct{}
+
+// Serialize implements Serializer.
+func (JSONSerializer) Serialize(sess *sessions.Session) ([]byte, error) {
+	m := make(map[string]interface{}, len(sess.Values))
+	for k, v := range sess.Values {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("json serializer: non-string key %v in session values", k)
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize implements Serializer.
+func (JSONSerializer) Deserialize(data []byte, sess *sessions.Session) error {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("json serializer: decoding: %s", err)
+	}
+	sess.Values = make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		sess.Values[k] = v
+	}
+	return nil
+}
+
+// protoValueKey is the well-known key under which ProtoSerializer expects
+// to find the proto.Message to store.
+const protoValueKey = "_proto"
+
+// ProtoSerializer serializes a single protobuf message stored in
+// session.Values under the "_proto" key, using New to allocate a fresh
+// message on Deserialize. Unlike GobSerializer and JSONSerializer, it does
+// not serialize the rest of session.Values.
+type ProtoSerializer struct {
+	New func() proto.Message
 }
 
-// DefaultIDGenerator is the default implementation of IDGeneratorFunc.
-// It generates a UUID V4 string.
+// Serialize implements Serializer.
+func (p ProtoSerializer) Serialize(sess *sessions.Session) ([]byte, error) {
+	msg, ok := sess.Values[protoValueKey].(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("proto serializer: session value %q is not a proto.Message", protoValueKey)
+	}
+	return proto.Marshal(msg)
+}
+
+// Deserialize implements Serializer.
+func (p ProtoSerializer) Deserialize(data []byte, sess *sessions.Session) error {
+	if p.New == nil {
+		return errors.New("proto serializer: New is not set")
+	}
+	msg := p.New()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("proto serializer: decoding: %s", err)
+	}
+	if sess.Values == nil {
+		sess.Values = make(map[interface{}]interface{})
+	}
+	sess.Values[protoValueKey] = msg
+	return nil
+}
+
+// DefaultIDGenerator is the default implementation of IDGeneratorFunc. It
+// generates a 32-byte, crypto/rand-backed ID, base64url-encoded, the same
+// scheme securecookie.GenerateRandomKey and most session libraries use for
+// unguessable session identifiers.
 func DefaultIDGenerator() IDGeneratorFunc {
 	return func(_ *http.Request) (string, error) {
-		return uuid.NewV4().String(), nil
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("generating random ID: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+}
+
+// UUIDv4Generator generates a random UUID V4 string for each session.
+func UUIDv4Generator() IDGeneratorFunc {
+	return func(_ *http.Request) (string, error) {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return "", fmt.Errorf("generating UUID v4: %s", err)
+		}
+		return id.String(), nil
+	}
+}
+
+// UUIDv7Generator generates a time-ordered UUID V7 string for each session.
+// Because UUID v7 IDs are monotonically increasing, they are cheaper for
+// bbolt to index than the random IDs DefaultIDGenerator and UUIDv4Generator
+// produce, as B+tree writes append at the right edge of the tree instead of
+// splitting pages throughout it.
+func UUIDv7Generator() IDGeneratorFunc {
+	return func(_ *http.Request) (string, error) {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return "", fmt.Errorf("generating UUID v7: %s", err)
+		}
+		return id.String(), nil
+	}
+}
+
+// PrefixedGenerator wraps inner, prepending prefix to every ID it
+// generates. This is useful in multi-tenant deployments, where IDs for
+// different tenants must not collide and should sort together in the
+// bucket.
+func PrefixedGenerator(prefix string, inner IDGeneratorFunc) IDGeneratorFunc {
+	return func(r *http.Request) (string, error) {
+		id, err := inner(r)
+		if err != nil {
+			return "", err
+		}
+		return prefix + id, nil
 	}
 }
 
 // Keys sets the key pairs for encryting and signing the secure cookies
 // set.
-//
 func Keys(keyPairs ...[]byte) SessionStoreOption {
 	return func(s *store) error {
-		s.codecs = securecookie.CodecsFromPairs(keyPairs...)
+		codecs := securecookie.CodecsFromPairs(keyPairs...)
+		for _, c := range codecs {
+			if sc, ok := c.(*securecookie.SecureCookie); ok {
+				// The Serializer configured via WithSerializer already
+				// turned the payload into bytes; securecookie only needs
+				// to authenticate and optionally encrypt them, not
+				// re-encode them.
+				sc.SetSerializer(securecookie.NopEncoder{})
+
+				// The same codecs also authenticate/encrypt the session
+				// payload written to the bucket, not just the cookie.
+				// securecookie's default 4096-byte MaxLength is sized for
+				// cookies; lift it here so it doesn't reject server-side
+				// values (e.g. an oauthsession access/refresh/id token
+				// triple, which routinely exceeds that size).
+				sc.MaxLength(0)
+			}
+		}
+		s.codecs = codecs
+		return nil
+	}
+}
+
+// WithSerializer sets the Serializer used to turn session values into bytes
+// before they are authenticated/encrypted via securecookie and written to
+// the bucket.
+//
+// By default, a GobSerializer is used.
+func WithSerializer(sz Serializer) SessionStoreOption {
+	return func(s *store) error {
+		s.serializer = sz
+		return nil
+	}
+}
+
+// AvoidEmptySessions toggles whether Save skips writing a new session that
+// has no values (and thus no flashes) to the bucket, and skips sending a
+// Set-Cookie for it. This keeps anonymous visitors from creating a row per
+// request. Defaults to true; pass false to write every session regardless
+// of whether it carries any data.
+func AvoidEmptySessions(avoid bool) SessionStoreOption {
+	return func(s *store) error {
+		s.avoidEmptySessions = avoid
 		return nil
 	}
 }
 
 // IDGenerator sets the function that is used to generate unique IDs for each session.
 //
-// By default, a UUID V4 is used to generate unique IDs.
+// By default, DefaultIDGenerator is used.
 func IDGenerator(f IDGeneratorFunc) SessionStoreOption {
 	return func(s *store) error {
 		s.genfunc = f
@@ -83,18 +322,76 @@ func SessionOptions(options *sessions.Options) SessionStoreOption {
 	}
 }
 
+// LegacyRawIDCookie toggles whether the session ID is written to and read
+// from the cookie as-is, instead of being run through securecookie along
+// with the rest of the cookie's payload.
+//
+// This exists purely for backwards compatibility with deployments that
+// already have cookies containing raw session IDs in the wild; new
+// deployments should leave this at its default of false so that forged
+// or tampered cookies are rejected before a bucket lookup is attempted.
+func LegacyRawIDCookie(legacy bool) SessionStoreOption {
+	return func(s *store) error {
+		s.legacyRawIDCookie = legacy
+		return nil
+	}
+}
+
+// GCInterval enables a background goroutine that periodically removes
+// expired sessions from the bucket, running every d. If this option is
+// never applied, no janitor goroutine is started and expired entries are
+// only ever cleaned up lazily, as they are read via Get.
+func GCInterval(d time.Duration) SessionStoreOption {
+	return func(s *store) error {
+		s.gcInterval = d
+		return nil
+	}
+}
+
+// MinGCBatchSize caps the number of entries a single GC transaction
+// inspects before it commits and yields the bucket back to regular readers
+// and writers, keeping the janitor from starving other transactions on
+// large buckets. Defaults to DefaultGCBatchSize.
+func MinGCBatchSize(n int) SessionStoreOption {
+	return func(s *store) error {
+		s.minGCBatchSize = n
+		return nil
+	}
+}
+
+// MaxGCTxDuration bounds the wall-clock time a single GC transaction is
+// allowed to run, in addition to MinGCBatchSize. Whichever limit is hit
+// first ends the transaction. Defaults to DefaultMaxGCTxDuration.
+func MaxGCTxDuration(d time.Duration) SessionStoreOption {
+	return func(s *store) error {
+		s.maxGCTxDuration = d
+		return nil
+	}
+}
+
+// SessionStore is the interface returned by New. Besides the
+// sessions.Store contract expected by gorilla/sessions, it exposes Close,
+// which stops the background GC goroutine started via GCInterval, if any.
+type SessionStore interface {
+	sessions.Store
+	Close() error
+}
+
 // New creates a new session store for gorilla/sessions backed by
 // "go.etcd.io/bbolt". The configured bucket is also created.
 //
 // Returns a new session store or nil and an error if an error occured.
 // If no keys were given, the error returned is ErrInsufficientKeys.
-func New(db *bolt.DB, opts ...SessionStoreOption) (sessions.Store, error) {
+func New(db *bolt.DB, opts ...SessionStoreOption) (SessionStore, error) {
 	s := &store{
 		db: db,
 		sessionOpts: &sessions.Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
 		},
+		minGCBatchSize:     DefaultGCBatchSize,
+		maxGCTxDuration:    DefaultMaxGCTxDuration,
+		avoidEmptySessions: true,
 	}
 	var err error
 	for _, opt := range opts {
@@ -111,6 +408,10 @@ func New(db *bolt.DB, opts ...SessionStoreOption) (sessions.Store, error) {
 		s.genfunc = DefaultIDGenerator()
 	}
 
+	if s.serializer == nil {
+		s.serializer = GobSerializer{}
+	}
+
 	if len(s.bucket) == 0 {
 		s.bucket = []byte(DefaultBucketname)
 	}
@@ -122,84 +423,270 @@ func New(db *bolt.DB, opts ...SessionStoreOption) (sessions.Store, error) {
 	if err != nil {
 		return nil, fmt.Errorf("initializing bucket: %s", err)
 	}
+
+	if s.gcInterval > 0 {
+		s.stopGC = make(chan struct{})
+		s.gcStopped = make(chan struct{})
+		go s.runGC()
+	}
+
 	return s, nil
 }
 
-// New satisfies the sessions.Store interface.
-func (s *store) New(r *http.Request, name string) (*sessions.Session, error) {
+// Close stops the background GC goroutine started via GCInterval, if any,
+// and waits for it to finish. It is safe to call Close even if GCInterval
+// was never set.
+func (s *store) Close() error {
+	if s.stopGC == nil {
+		return nil
+	}
+	close(s.stopGC)
+	<-s.gcStopped
+	return nil
+}
 
-	var err error
+func (s *store) runGC() {
+	defer close(s.gcStopped)
 
-	sess := sessions.NewSession(s, name)
-	opts := *s.sessionOpts
-	sess.Options = &opts
-	sess.IsNew = true
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
 
-	if sess.ID, err = s.genfunc(r); err != nil {
-		return nil, fmt.Errorf("generating ID: %s", err)
+	for {
+		select {
+		case <-s.stopGC:
+			return
+		case <-ticker.C:
+			s.collectExpired()
+		}
 	}
-	return sess, nil
 }
 
-func (s *store) Get(r *http.Request, name string) (*sessions.Session, error) {
+// collectExpired sweeps the whole bucket, removing expired entries in
+// bounded-size write transactions so a large bucket does not stall readers
+// and writers for the duration of the sweep.
+func (s *store) collectExpired() {
+	var after []byte
+	for {
+		next, done, err := s.collectExpiredBatch(after)
+		if err != nil || done {
+			return
+		}
+		after = next
+	}
+}
 
-	var sess *sessions.Session
+func (s *store) collectExpiredBatch(after []byte) (next []byte, done bool, err error) {
+	now := time.Now()
+	start := time.Now()
+	inspected := 0
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		var k, v []byte
+		if after == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(after)
+			if k != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			rec, err := decodeRecord(v)
+			if err == nil && rec.expired(now) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			next = append([]byte(nil), k...)
+			inspected++
+			if inspected >= s.minGCBatchSize || time.Since(start) >= s.maxGCTxDuration {
+				k, _ = c.Next()
+				done = k == nil
+				return nil
+			}
+		}
+		done = true
+		return nil
+	})
+	return next, done, err
+}
 
-	id, err := retrieveSessionID(r, name)
+// New satisfies the sessions.Store interface. If the request carries a
+// valid session cookie and the corresponding, unexpired entry is found in
+// the bucket, the returned session has IsNew set to false and its Values
+// populated from the bucket. Otherwise a fresh session with a new ID is
+// returned, with IsNew set to true.
+func (s *store) New(r *http.Request, name string) (*sessions.Session, error) {
 
-	if err != nil && err == http.ErrNoCookie {
-		sess, _ = s.New(r, name)
-		return sess, nil
+	sess := sessions.NewSession(s, name)
+	opts := *s.sessionOpts
+	sess.Options = &opts
+	sess.IsNew = true
+
+	// Only generate a new ID once we know the request doesn't carry a
+	// loadable session; generating one for every call is wasted work on
+	// the (common) existing-session path.
+	assignID := func() error {
+		id, err := s.genfunc(r)
+		if err != nil {
+			return fmt.Errorf("generating ID: %s", err)
+		}
+		sess.ID = id
+		return nil
+	}
+
+	id, err := s.retrieveSessionID(r, name)
+	if err == http.ErrNoCookie {
+		return sess, assignID()
 	} else if err != nil {
-		return nil, fmt.Errorf("retrieving session cookie: %s", err)
+		if genErr := assignID(); genErr != nil {
+			return sess, genErr
+		}
+		return sess, fmt.Errorf("retrieving session cookie: %s", err)
+	}
+
+	loaded, err := s.load(id, name)
+	if err != nil {
+		if genErr := assignID(); genErr != nil {
+			return sess, genErr
+		}
+		return sess, fmt.Errorf("retrieving session from database: %s", err)
 	}
+	return loaded, nil
+}
 
-	err = s.db.View(func(tx *bolt.Tx) error {
-		raw := tx.Bucket(s.bucket).Get([]byte(id))
+// load reads and decodes the session stored under id, deleting it if it
+// turns out to be expired. It returns ErrSessionNotStored if there is no
+// live entry for id.
+//
+// The lookup itself runs in a db.View; bbolt serializes all writers behind
+// a single lock, so the common, read-only path must not pay for one. Only
+// the rare expired-entry case escalates to a short db.Update to delete the
+// stale row.
+func (s *store) load(id, name string) (*sessions.Session, error) {
+	var sess *sessions.Session
+	var expired bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		raw := b.Get([]byte(id))
 		if raw == nil {
 			return ErrSessionNotStored
 		}
+		rec, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("unmarshalling session entry: %s", err)
+		}
+		if rec.expired(time.Now()) {
+			expired = true
+			return ErrSessionNotStored
+		}
+		var payload []byte
+		if err := securecookie.DecodeMulti(name, rec.Payload, &payload, s.codecs...); err != nil {
+			return fmt.Errorf("unmarshalling session: %s", err)
+		}
 		sess = sessions.NewSession(s, name)
 		sess.ID = id
-		err := securecookie.DecodeMulti(name, string(raw), &sess.Values, s.codecs...)
-		if err != nil {
+		opts := *s.sessionOpts
+		sess.Options = &opts
+		if err := s.serializer.Deserialize(payload, sess); err != nil {
 			return fmt.Errorf("unmarshalling session: %s", err)
 		}
 		return nil
 	})
+
+	if expired {
+		if delErr := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(s.bucket).Delete([]byte(id))
+		}); delErr != nil {
+			return nil, fmt.Errorf("deleting expired session: %s", delErr)
+		}
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("retrieving session from database: %s", err)
+		return nil, err
 	}
 	return sess, nil
 }
 
+// Get satisfies the sessions.Store interface by delegating to the
+// request-scoped sessions.Registry, so that repeated calls to Get with the
+// same name within one request return the same *sessions.Session, as
+// required by gorilla/sessions (e.g. for AddFlash to be visible across
+// handlers sharing a request).
+func (s *store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
 func (s *store) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
 
+	if sess.Options != nil && sess.Options.MaxAge < 0 {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(s.bucket).Delete([]byte(sess.ID))
+		})
+		if err != nil {
+			return fmt.Errorf("deleting session %s: %s", sess.ID, err)
+		}
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	if s.avoidEmptySessions && sess.IsNew && len(sess.Values) == 0 {
+		return nil
+	}
+
+	var expiresAt time.Time
+	if sess.Options != nil && sess.Options.MaxAge > 0 {
+		expiresAt = time.Now().Add(time.Duration(sess.Options.MaxAge) * time.Second)
+	}
+
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		sess.IsNew = false
-		d, err := securecookie.EncodeMulti(sess.Name(), &sess.Values, s.codecs...)
+		data, err := s.serializer.Serialize(sess)
+		if err != nil {
+			return fmt.Errorf("serializing session: %s", err)
+		}
+		payload, err := securecookie.EncodeMulti(sess.Name(), data, s.codecs...)
 		if err != nil {
 			return fmt.Errorf("encoding session: %s", err)
 		}
-		return tx.Bucket(s.bucket).Put([]byte(sess.ID), []byte(d))
+		raw, err := encodeRecord(sessionRecord{Payload: payload, ExpiresAt: expiresAt})
+		if err != nil {
+			return fmt.Errorf("encoding session entry: %s", err)
+		}
+		return tx.Bucket(s.bucket).Put([]byte(sess.ID), raw)
 	})
 
 	if err != nil {
 		return fmt.Errorf("saving session %s: %s", sess.ID, err)
 	}
 
-	http.SetCookie(w, s.newCookie(sess.Name(), sess.ID))
+	cookieValue := sess.ID
+	if !s.legacyRawIDCookie {
+		if cookieValue, err = securecookie.EncodeMulti(sess.Name(), []byte(sess.ID), s.codecs...); err != nil {
+			return fmt.Errorf("encoding session cookie: %s", err)
+		}
+	}
+
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), cookieValue, sess.Options))
 	return nil
 }
 
-func (s *store) newCookie(name, id string) *http.Cookie {
-	return &http.Cookie{
-		Name:  name,
-		Value: id,
-	}
+// Delete explicitly drops sess from the store and expires its cookie,
+// regardless of AvoidEmptySessions. It is equivalent to setting
+// sess.Options.MaxAge to a negative value and calling sess.Save.
+func Delete(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	sess.Options.MaxAge = -1
+	return sess.Save(r, w)
 }
 
-func retrieveSessionID(r *http.Request, name string) (string, error) {
+func (s *store) retrieveSessionID(r *http.Request, name string) (string, error) {
+	if r == nil {
+		return "", http.ErrNoCookie
+	}
+
 	c, err := r.Cookie(name)
 
 	if err != nil && err == http.ErrNoCookie {
@@ -208,5 +695,13 @@ func retrieveSessionID(r *http.Request, name string) (string, error) {
 		return "", fmt.Errorf("retrieving session cookie: %s", err)
 	}
 
-	return c.Value, nil
+	if s.legacyRawIDCookie {
+		return c.Value, nil
+	}
+
+	var id []byte
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.codecs...); err != nil {
+		return "", fmt.Errorf("decoding session cookie: %s", err)
+	}
+	return string(id), nil
 }
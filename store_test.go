@@ -19,15 +19,19 @@ package boltstore_test
 
 import (
 	"context"
+	"encoding/base64"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
 	boltstore "github.com/mwmahlberg/gorilla-boltstore"
-	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	bolt "go.etcd.io/bbolt"
@@ -72,6 +76,13 @@ func (suite *StoreSuite) TearDownTest() {
 	os.Remove(suite.db.Path())
 }
 
+// isValidRandomID reports whether s is a base64url-encoded, 32-byte
+// identifier, as produced by boltstore.DefaultIDGenerator.
+func isValidRandomID(s string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
 func (suite *StoreSuite) TestNewStore() {
 
 	hash := make([]byte, 64)
@@ -105,30 +116,61 @@ func (suite *StoreSuite) TestNewStore() {
 				boltstore.IDGenerator(boltstore.DefaultIDGenerator()),
 				boltstore.Keys(hash, key),
 			},
+			isValidID: isValidRandomID,
+		},
+		{
+			desc:      "Nil Generator",
+			db:        suite.db,
+			opts:      []boltstore.SessionStoreOption{boltstore.Keys(hash, key)},
+			isValidID: isValidRandomID,
+		},
+		{
+			desc: "Custom bucket name",
+			db:   suite.db,
+			opts: []boltstore.SessionStoreOption{
+				boltstore.SessionBucket("customBucket"),
+				boltstore.Keys(hash, key),
+			},
+			isValidID: isValidRandomID,
+		},
+		{
+			desc: "UUID v4 generator",
+			db:   suite.db,
+			opts: []boltstore.SessionStoreOption{
+				boltstore.IDGenerator(boltstore.UUIDv4Generator()),
+				boltstore.Keys(hash, key),
+			},
 			isValidID: func(s string) bool {
-				id, err := uuid.FromString(s)
-				return id.Version() == uuid.V4 && err == nil
+				id, err := uuid.Parse(s)
+				return err == nil && id.Version() == 4
 			},
 		},
 		{
-			desc: "Nil Generator",
+			desc: "UUID v7 generator",
 			db:   suite.db,
-			opts: []boltstore.SessionStoreOption{boltstore.Keys(hash, key)},
+			opts: []boltstore.SessionStoreOption{
+				boltstore.IDGenerator(boltstore.UUIDv7Generator()),
+				boltstore.Keys(hash, key),
+			},
 			isValidID: func(s string) bool {
-				id, err := uuid.FromString(s)
-				return id.Version() == uuid.V4 && err == nil
+				id, err := uuid.Parse(s)
+				return err == nil && id.Version() == 7
 			},
 		},
 		{
-			desc: "Custom bucket name",
+			desc: "Prefixed generator",
 			db:   suite.db,
 			opts: []boltstore.SessionStoreOption{
-				boltstore.SessionBucket("customBucket"),
+				boltstore.IDGenerator(boltstore.PrefixedGenerator("tenant-a:", boltstore.UUIDv4Generator())),
 				boltstore.Keys(hash, key),
 			},
 			isValidID: func(s string) bool {
-				id, err := uuid.FromString(s)
-				return id.Version() == uuid.V4 && err == nil
+				const prefix = "tenant-a:"
+				if len(s) <= len(prefix) || s[:len(prefix)] != prefix {
+					return false
+				}
+				id, err := uuid.Parse(s[len(prefix):])
+				return err == nil && id.Version() == 4
 			},
 		},
 	}
@@ -145,6 +187,125 @@ func (suite *StoreSuite) TestNewStore() {
 	}
 }
 
+func (suite *StoreSuite) TestExpiry() {
+	st, err := boltstore.New(
+		suite.db,
+		boltstore.Keys([]byte("foo")),
+		boltstore.SessionOptions(&sessions.Options{Path: "/", MaxAge: 1}),
+	)
+	assert.NoError(suite.T(), err, "creating new session store: %s", err)
+
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	sess, err := st.Get(r, "testcookie")
+	assert.NoError(suite.T(), err)
+	sess.Values["foo"] = "bar"
+
+	w := httptest.NewRecorder()
+	assert.NoError(suite.T(), sess.Save(r, w))
+	w.Flush()
+
+	second := r.Clone(context.TODO())
+	second.AddCookie(w.Result().Cookies()[0])
+
+	time.Sleep(2 * time.Second)
+
+	_, err = st.Get(second, "testcookie")
+	assert.Error(suite.T(), err, "expired session was not rejected")
+	assert.Contains(suite.T(), err.Error(), boltstore.ErrSessionNotStored.Error())
+}
+
+func (suite *StoreSuite) TestJSONSerializer() {
+	st, err := boltstore.New(
+		suite.db,
+		boltstore.Keys([]byte("foo")),
+		boltstore.WithSerializer(boltstore.JSONSerializer{}),
+	)
+	assert.NoError(suite.T(), err, "creating new session store: %s", err)
+
+	first, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	sess, err := st.Get(first, "testcookie")
+	assert.NoError(suite.T(), err)
+	sess.Values["foo"] = "bar"
+
+	w := httptest.NewRecorder()
+	assert.NoError(suite.T(), sess.Save(first, w))
+	w.Flush()
+
+	second := first.Clone(context.TODO())
+	second.AddCookie(w.Result().Cookies()[0])
+
+	restored, err := st.Get(second, "testcookie")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "bar", restored.Values["foo"])
+}
+
+// TestLargeValue guards against regressing the securecookie MaxLength cap:
+// the server-side session payload is authenticated/encrypted with the same
+// codecs as the cookie, and Keys lifts securecookie's 4096-byte default on
+// those codecs so that a larger payload is still accepted.
+func (suite *StoreSuite) TestLargeValue() {
+	st, err := boltstore.New(
+		suite.db,
+		boltstore.Keys([]byte("foo")),
+		boltstore.WithSerializer(boltstore.JSONSerializer{}),
+	)
+	assert.NoError(suite.T(), err, "creating new session store: %s", err)
+
+	large := strings.Repeat("x", 8192)
+
+	first, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	sess, err := st.Get(first, "testcookie")
+	assert.NoError(suite.T(), err)
+	sess.Values["foo"] = large
+
+	w := httptest.NewRecorder()
+	assert.NoError(suite.T(), sess.Save(first, w))
+	w.Flush()
+
+	second := first.Clone(context.TODO())
+	second.AddCookie(w.Result().Cookies()[0])
+
+	restored, err := st.Get(second, "testcookie")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), large, restored.Values["foo"])
+}
+
+func (suite *StoreSuite) TestAvoidEmptySessions() {
+	st, err := boltstore.New(suite.db, boltstore.Keys([]byte("foo")))
+	assert.NoError(suite.T(), err, "creating new session store: %s", err)
+
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	sess, err := st.Get(r, "testcookie")
+	assert.NoError(suite.T(), err)
+
+	w := httptest.NewRecorder()
+	assert.NoError(suite.T(), sess.Save(r, w))
+	w.Flush()
+	assert.Empty(suite.T(), w.Result().Cookies(), "cookie was set for an empty, new session")
+
+	sess.Values["foo"] = "bar"
+	w = httptest.NewRecorder()
+	assert.NoError(suite.T(), sess.Save(r, w))
+	w.Flush()
+	assert.NoError(suite.T(), boltstore.Delete(r, w, sess))
+}
+
+func (suite *StoreSuite) TestGetReusesRegisteredSession() {
+	st, err := boltstore.New(suite.db, boltstore.Keys([]byte("foo")))
+	assert.NoError(suite.T(), err, "creating new session store: %s", err)
+
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+
+	first, err := st.Get(r, "testcookie")
+	assert.NoError(suite.T(), err)
+	first.AddFlash("hello")
+
+	second, err := st.Get(r, "testcookie")
+	assert.NoError(suite.T(), err)
+	assert.Same(suite.T(), first, second, "Get did not return the session registered for this request")
+	assert.Equal(suite.T(), []interface{}{"hello"}, second.Flashes())
+}
+
 func (suite *StoreSuite) TestLC() {
 	testCases := []struct {
 		desc           string
@@ -183,7 +344,7 @@ func (suite *StoreSuite) TestLC() {
 		},
 	}
 
-	st, err := boltstore.New(suite.db, boltstore.Keys([]byte("foo")))
+	st, err := boltstore.New(suite.db, boltstore.Keys([]byte("foo")), boltstore.AvoidEmptySessions(false))
 	assert.NoError(suite.T(), err, "creating new session store: %s", err)
 	assert.NotNil(suite.T(), st, "session store is nil after creation")
 